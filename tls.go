@@ -17,102 +17,909 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ocsp"
 	"golang.org/x/crypto/pkcs12"
 )
 
+// defaultReloadInterval is how often the keystore is re-read as a
+// fallback for filesystems where inotify events are unreliable (NFS,
+// bind mounts, etc), used when no --keystore-reload-interval is given.
+const defaultReloadInterval = 15 * time.Minute
+
+// keystoreFormat identifies the on-disk encoding of a keystore.
+type keystoreFormat string
+
+const (
+	// formatAuto sniffs the keystore file to determine its format.
+	formatAuto keystoreFormat = ""
+	// formatPKCS12 is the historical ghostunnel default (.p12/.pfx).
+	formatPKCS12 keystoreFormat = "pkcs12"
+	// formatPEM is a PEM-encoded cert+key pair (optionally concatenated).
+	formatPEM keystoreFormat = "pem"
+	// formatPKCS11 addresses a key/cert pair held in an HSM via a pkcs11: URI.
+	formatPKCS11 keystoreFormat = "pkcs11"
+)
+
+// KeystoreLoader loads a TLS certificate and private key from a keystore
+// of some format, given a path (or URI, for PKCS#11) and an optional
+// passphrase.
+type KeystoreLoader interface {
+	Load(path, pass string) (tls.Certificate, error)
+}
+
+// pkcs12Loader loads certificates from PKCS#12 keystores.
+type pkcs12Loader struct{}
+
+func (pkcs12Loader) Load(path, pass string) (tls.Certificate, error) {
+	keystoreBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pemBlocks, err := pkcs12.ToPEM(keystoreBytes, pass)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var pemBytes []byte
+	for _, block := range pemBlocks {
+		pemBytes = append(pemBytes, pem.EncodeToMemory(block)...)
+	}
+
+	return tls.X509KeyPair(pemBytes, pemBytes)
+}
+
+// pemLoader loads certificates from a PEM file containing a certificate
+// (and chain) followed by a private key, which may itself be encrypted
+// with the given passphrase.
+type pemLoader struct{}
+
+func (pemLoader) Load(path, pass string) (tls.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var certPEM []byte
+	var keyBlock *pem.Block
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keyBlock = block
+			continue
+		}
+
+		certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+	}
+
+	if keyBlock == nil {
+		return tls.Certificate{}, fmt.Errorf("pem keystore: no private key block found in %s", path)
+	}
+
+	keyDER := keyBlock.Bytes
+	if x509.IsEncryptedPEMBlock(keyBlock) {
+		if pass == "" {
+			return tls.Certificate{}, fmt.Errorf("pem keystore: %s is passphrase-protected but no passphrase was given", path)
+		}
+
+		keyDER, err = x509.DecryptPEMBlock(keyBlock, []byte(pass))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("pem keystore: unable to decrypt private key: %s", err)
+		}
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: keyBlock.Type, Bytes: keyDER})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// pkcs11Loader loads certificates from a key/cert pair held in an HSM,
+// addressed by a pkcs11: URI (RFC 7512). The passphrase is used as the
+// token/slot PIN unless the URI itself carries a pin-value attribute.
+type pkcs11Loader struct{}
+
+func (pkcs11Loader) Load(uri, pass string) (tls.Certificate, error) {
+	attrs, err := parsePKCS11URI(uri, pass)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s", err)
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       attrs.modulePath,
+		TokenLabel: attrs.tokenLabel,
+		Pin:        attrs.pin,
+	})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s", err)
+	}
+
+	signer, err := ctx.FindKeyPair(attrs.objectID, []byte(attrs.objectLabel))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s", err)
+	}
+	if signer == nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s does not reference a key pair", uri)
+	}
+
+	cert, err := ctx.FindCertificate(attrs.objectID, []byte(attrs.objectLabel), nil)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s", err)
+	}
+	if cert == nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs11 keystore: %s does not reference a certificate object", uri)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  signer,
+		Leaf:        cert,
+	}, nil
+}
+
+// pkcs11URIAttrs holds the RFC 7512 attributes we care about out of a
+// pkcs11: URI, e.g. "pkcs11:token=my-token;object=my-key?module-path=/usr/lib/softhsm2.so&pin-value=1234".
+type pkcs11URIAttrs struct {
+	modulePath  string
+	tokenLabel  string
+	objectLabel string
+	objectID    []byte
+	pin         string
+}
+
+// parsePKCS11URI parses the path and query attributes of a pkcs11: URI.
+// pass is used as the PIN unless the URI's pin-value query attribute is
+// set, in which case that takes precedence.
+func parsePKCS11URI(uri, pass string) (*pkcs11URIAttrs, error) {
+	if !strings.HasPrefix(uri, "pkcs11:") {
+		return nil, fmt.Errorf("not a pkcs11 URI: %s", uri)
+	}
+	body := strings.TrimPrefix(uri, "pkcs11:")
+
+	pathPart, queryPart := body, ""
+	if idx := strings.Index(body, "?"); idx >= 0 {
+		pathPart, queryPart = body[:idx], body[idx+1:]
+	}
+
+	attrs := &pkcs11URIAttrs{pin: pass}
+
+	for _, component := range strings.Split(pathPart, ";") {
+		key, val, err := splitPKCS11Attr(component, url.PathUnescape)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "token":
+			attrs.tokenLabel = val
+		case "object":
+			attrs.objectLabel = val
+		case "id":
+			attrs.objectID = []byte(val)
+		}
+	}
+
+	for _, component := range strings.Split(queryPart, "&") {
+		key, val, err := splitPKCS11Attr(component, url.QueryUnescape)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "module-path":
+			attrs.modulePath = val
+		case "pin-value":
+			attrs.pin = val
+		}
+	}
+
+	if attrs.modulePath == "" {
+		return nil, fmt.Errorf("pkcs11 uri %q is missing the module-path attribute", uri)
+	}
+	return attrs, nil
+}
+
+// splitPKCS11Attr splits a single "key=value" URI component, unescaping
+// both sides with the given unescape function. Empty components (as from
+// a trailing separator) are returned as "", "", nil.
+func splitPKCS11Attr(component string, unescape func(string) (string, error)) (key, value string, err error) {
+	if component == "" {
+		return "", "", nil
+	}
+
+	parts := strings.SplitN(component, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("malformed pkcs11 uri attribute: %s", component)
+	}
+
+	key, err = unescape(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	value, err = unescape(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// sniffKeystoreFormat inspects a keystore path/URI to guess its format
+// when the caller did not pass --keystore-format explicitly.
+func sniffKeystoreFormat(path string) (keystoreFormat, error) {
+	if strings.HasPrefix(path, "pkcs11:") {
+		return formatPKCS11, nil
+	}
+
+	header := make([]byte, 27) // len("-----BEGIN CERTIFICATE-----"), enough to detect PEM
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return formatAuto, err
+	}
+	n := copy(header, f)
+
+	if strings.HasPrefix(string(header[:n]), "-----BEGIN") {
+		return formatPEM, nil
+	}
+
+	return formatPKCS12, nil
+}
+
+// loaderFor returns the KeystoreLoader to use for the given format,
+// sniffing the keystore if format is formatAuto.
+func loaderFor(path string, format keystoreFormat) (KeystoreLoader, error) {
+	if format == formatAuto {
+		var err error
+		format, err = sniffKeystoreFormat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case formatPKCS12:
+		return pkcs12Loader{}, nil
+	case formatPEM:
+		return pemLoader{}, nil
+	case formatPKCS11:
+		return pkcs11Loader{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported keystore format: %s", format)
+	}
+}
+
 // certificate wraps a TLS certificate in a reloadable way
 type certificate struct {
 	keystorePath, keystorePass string
+	format                     keystoreFormat
+	loader                     KeystoreLoader
 	cached                     unsafe.Pointer
+	ocspHardFail               bool
+	ocspRevoked                int32
+
+	watcher  *fsnotify.Watcher
+	ticker   *time.Ticker
+	sighupCh chan os.Signal
+	stopCh   chan struct{}
 }
 
 // Build reloadable certificate
-func buildCertificate(keystorePath, keystorePass string) (*certificate, error) {
-	cert := &certificate{keystorePath, keystorePass, nil}
-	err := cert.reload()
+func buildCertificate(keystorePath, keystorePass string, format string, reloadInterval time.Duration, ocspHardFail bool) (*certificate, error) {
+	resolvedFormat := keystoreFormat(format)
+	if resolvedFormat == formatAuto {
+		var err error
+		resolvedFormat, err = sniffKeystoreFormat(keystorePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loader, err := loaderFor(keystorePath, resolvedFormat)
 	if err != nil {
 		return nil, err
 	}
+
+	cert := &certificate{keystorePath: keystorePath, keystorePass: keystorePass, format: resolvedFormat, loader: loader, ocspHardFail: ocspHardFail}
+	if err := cert.reload(); err != nil {
+		return nil, err
+	}
+
+	if err := cert.startReloader(reloadInterval); err != nil {
+		return nil, err
+	}
+
+	go cert.ocspRefreshLoop()
 	return cert, nil
 }
 
+// startReloader watches the keystore for changes via fsnotify and also
+// reloads on a periodic ticker and on SIGHUP, so long-running processes
+// pick up renewed certificates without a restart. keystorePath is a
+// pkcs11: URI rather than a filesystem path for formatPKCS11, so there is
+// nothing for fsnotify to watch there -- the periodic ticker and SIGHUP
+// are the only reload triggers in that case.
+func (c *certificate) startReloader(periodicInterval time.Duration) error {
+	if periodicInterval <= 0 {
+		periodicInterval = defaultReloadInterval
+	}
+
+	if c.format != formatPKCS11 {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+
+		if err := watcher.Add(c.keystorePath); err != nil {
+			watcher.Close()
+			return err
+		}
+
+		c.watcher = watcher
+	}
+
+	c.ticker = time.NewTicker(periodicInterval)
+	c.sighupCh = make(chan os.Signal, 1)
+	c.stopCh = make(chan struct{})
+	signal.Notify(c.sighupCh, syscall.SIGHUP)
+
+	go c.watchLoop()
+	return nil
+}
+
+// watchLoop reacts to filesystem events, the periodic ticker and SIGHUP
+// by reloading the keystore. Most editors and certificate managers
+// replace a keystore file via an atomic rename, which invalidates the
+// fsnotify watch on the old inode -- we re-add the watch on the (now
+// replaced) path whenever we see a Remove or Rename event.
+func (c *certificate) watchLoop() {
+	// c.watcher is nil for formatPKCS11 keystores (nothing to watch on
+	// disk); reading from a nil channel blocks forever, which simply
+	// drops those two cases out of the select below.
+	var events chan fsnotify.Event
+	var errs chan error
+	if c.watcher != nil {
+		events = c.watcher.Events
+		errs = c.watcher.Errors
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if err := c.watcher.Add(c.keystorePath); err != nil {
+					log.Printf("keystore reload: unable to re-watch %s: %s", c.keystorePath, err)
+					continue
+				}
+			}
+			c.reloadAndLog()
+		case <-c.ticker.C:
+			c.reloadAndLog()
+		case <-c.sighupCh:
+			c.reloadAndLog()
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			log.Printf("keystore watch: %s", err)
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// reloadAndLog reloads the keystore, logging (but not propagating) any
+// error -- a failed reload must not clobber the certificate we already
+// have cached and are serving.
+func (c *certificate) reloadAndLog() {
+	if err := c.reload(); err != nil {
+		log.Printf("keystore reload: %s", err)
+	}
+}
+
+// ReloadNow triggers an immediate reload, e.g. in response to an
+// operator-initiated signal.
+func (c *certificate) ReloadNow() error {
+	return c.reload()
+}
+
+// Stop tears down the watcher, ticker and signal handler so the
+// certificate can be cleanly garbage collected during shutdown.
+func (c *certificate) Stop() {
+	if c.stopCh != nil {
+		close(c.stopCh)
+	}
+	if c.watcher != nil {
+		c.watcher.Close()
+	}
+	if c.ticker != nil {
+		c.ticker.Stop()
+	}
+	if c.sighupCh != nil {
+		signal.Stop(c.sighupCh)
+	}
+}
+
+// acmeCertificate obtains and renews certificates via ACME, e.g. from
+// Let's Encrypt, instead of reading them from a keystore on disk. It
+// exposes the same getCertificate(clientHello) shape as certificate so
+// either can be wired into tls.Config.GetCertificate.
+type acmeCertificate struct {
+	manager *autocert.Manager
+}
+
+// buildACMECertificate sets up automatic certificate management for the
+// given hostnames. serverNames restricts which hosts the manager will
+// request certificates for (autocert.HostWhitelist); cacheDir backs the
+// on-disk certificate cache; directoryURL overrides the ACME directory
+// (e.g. for the Let's Encrypt staging environment or a private CA) and
+// defaults to the Let's Encrypt production directory when empty.
+func buildACMECertificate(serverNames []string, cacheDir, directoryURL, email string) (*acmeCertificate, error) {
+	if len(serverNames) == 0 {
+		return nil, fmt.Errorf("acme: at least one --acme-server-name is required")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(serverNames...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+
+	if directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+
+	return &acmeCertificate{manager: manager}, nil
+}
+
+// getCertificate retrieves (obtaining or renewing via ACME as needed)
+// the certificate for the incoming handshake.
+func (a *acmeCertificate) getCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return a.manager.GetCertificate(clientHello)
+}
+
 // Retrieve actual certificate
 func (c *certificate) getCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.ocspHardFail && atomic.LoadInt32(&c.ocspRevoked) != 0 {
+		return nil, fmt.Errorf("certificate has been revoked (ocsp), refusing handshake")
+	}
 	return (*tls.Certificate)(atomic.LoadPointer(&c.cached)), nil
 }
 
 // Reload certificate
 func (c *certificate) reload() error {
-	keystoreBytes, err := ioutil.ReadFile(c.keystorePath)
+	certAndKey, err := c.loader.Load(c.keystorePath, c.keystorePass)
 	if err != nil {
 		return err
 	}
 
-	pemBlocks, err := pkcs12.ToPEM(keystoreBytes, c.keystorePass)
+	certAndKey.Leaf, err = x509.ParseCertificate(certAndKey.Certificate[0])
 	if err != nil {
 		return err
 	}
 
-	var pemBytes []byte
-	for _, block := range pemBlocks {
-		pemBytes = append(pemBytes, pem.EncodeToMemory(block)...)
+	atomic.StorePointer(&c.cached, unsafe.Pointer(&certAndKey))
+
+	// Stapling round-trips to the OCSP responder and possibly the
+	// issuer's AIA URL; do it in the background so an unreachable or
+	// slow CA endpoint can never block startup or a keystore reload.
+	go c.refreshOCSPStaple()
+
+	return nil
+}
+
+// staple fetches an OCSP response for certAndKey's leaf and, on success,
+// sets certAndKey.OCSPStaple so it gets served alongside the handshake.
+// Failures are logged but never prevent the (re)load from succeeding --
+// a missing staple just means clients fall back to their own revocation
+// checking.
+func (c *certificate) staple(certAndKey *tls.Certificate) {
+	resp, err := c.fetchOCSPStaple(certAndKey)
+	if err != nil {
+		log.Printf("ocsp: unable to staple response for %s: %s", c.keystorePath, err)
+		return
+	}
+	if resp == nil {
+		return // leaf has no OCSPServer to query
+	}
+
+	if resp.Status == ocsp.Revoked {
+		log.Printf("ocsp: certificate %s has been REVOKED", c.keystorePath)
+		atomic.StoreInt32(&c.ocspRevoked, 1)
+	} else {
+		atomic.StoreInt32(&c.ocspRevoked, 0)
+	}
+}
+
+// fetchOCSPStaple builds and sends an OCSP request for certAndKey's leaf
+// and, on success, stores the raw response in certAndKey.OCSPStaple. It
+// returns nil, nil if the leaf has no OCSPServer URLs to query.
+func (c *certificate) fetchOCSPStaple(certAndKey *tls.Certificate) (*ocsp.Response, error) {
+	leaf := certAndKey.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil
 	}
 
-	certAndKey, err := tls.X509KeyPair(pemBytes, pemBytes)
+	issuer, err := c.issuerCertificate(certAndKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	certAndKey.Leaf, err = x509.ParseCertificate(certAndKey.Certificate[0])
+	reqDER, err := ocsp.CreateRequest(leaf, issuer, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	atomic.StorePointer(&c.cached, unsafe.Pointer(&certAndKey))
-	return nil
+	var lastErr error
+	for _, server := range leaf.OCSPServer {
+		respDER, err := postOCSPRequest(server, reqDER)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := ocsp.ParseResponse(respDER, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		certAndKey.OCSPStaple = respDER
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("all OCSP responders failed, last error: %s", lastErr)
+}
+
+// issuerCertificate finds the leaf's issuer, preferring the chain
+// shipped alongside the leaf and falling back to fetching it from the
+// leaf's IssuingCertificateURL (as CAs like Let's Encrypt rotate
+// intermediates without necessarily re-issuing leaves).
+func (c *certificate) issuerCertificate(certAndKey *tls.Certificate) (*x509.Certificate, error) {
+	leaf := certAndKey.Leaf
+	for _, der := range certAndKey.Certificate[1:] {
+		candidate, err := x509.ParseCertificate(der)
+		if err == nil && bytes.Equal(candidate.RawSubject, leaf.RawIssuer) {
+			return candidate, nil
+		}
+	}
+
+	if len(leaf.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("issuer not found in chain and leaf has no IssuingCertificateURL")
+	}
+
+	resp, err := ocspHTTPClient.Get(leaf.IssuingCertificateURL[0])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(body)
+}
+
+// ocspHTTPClient is used for OCSP responder and issuer (AIA) fetches,
+// both of which hit endpoints we don't control. A bounded timeout keeps
+// an unreachable or slow CA endpoint from hanging a staple refresh
+// indefinitely.
+var ocspHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// postOCSPRequest POSTs an OCSP request to responder and returns the raw
+// DER-encoded response.
+func postOCSPRequest(responder string, reqDER []byte) ([]byte, error) {
+	httpResp, err := ocspHTTPClient.Post(responder, "application/ocsp-request", bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	return ioutil.ReadAll(httpResp.Body)
 }
 
+// ocspRefreshLoop periodically re-fetches the OCSP staple for the
+// currently cached certificate, independent of keystore reloads, so the
+// staple stays fresh even if the underlying certificate doesn't change.
+func (c *certificate) ocspRefreshLoop() {
+	for {
+		timer := time.NewTimer(c.nextOCSPRefresh())
+		select {
+		case <-timer.C:
+			c.refreshOCSPStaple()
+		case <-c.stopCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// nextOCSPRefresh returns how long to wait before refreshing the staple:
+// one hour before the current staple's NextUpdate, or hourly if there is
+// no staple yet or it didn't set NextUpdate.
+func (c *certificate) nextOCSPRefresh() time.Duration {
+	const defaultOCSPRefreshInterval = time.Hour
+
+	cached := (*tls.Certificate)(atomic.LoadPointer(&c.cached))
+	if cached == nil || len(cached.OCSPStaple) == 0 {
+		return defaultOCSPRefreshInterval
+	}
+
+	resp, err := ocsp.ParseResponse(cached.OCSPStaple, nil)
+	if err != nil || resp.NextUpdate.IsZero() {
+		return defaultOCSPRefreshInterval
+	}
+
+	if until := time.Until(resp.NextUpdate) - time.Hour; until > 0 {
+		return until
+	}
+	return time.Minute
+}
+
+// refreshOCSPStaple re-fetches the OCSP staple for the currently cached
+// certificate and atomically swaps it in, without touching the
+// certificate or key themselves. c.staple's OCSP round trip can take up
+// to the ocspHTTPClient timeout, during which a concurrent reload() may
+// rotate c.cached to a newly-loaded certificate -- so the swap at the
+// end uses a compare-and-swap against the snapshot we started from
+// instead of an unconditional store, to avoid reverting that rotation.
+func (c *certificate) refreshOCSPStaple() {
+	old := atomic.LoadPointer(&c.cached)
+	cached := (*tls.Certificate)(old)
+	if cached == nil {
+		return
+	}
+
+	updated := *cached
+	c.staple(&updated)
+	atomic.CompareAndSwapPointer(&c.cached, old, unsafe.Pointer(&updated))
+}
+
+// systemCertDirs lists the well-known locations OS package managers drop
+// trust anchors into, used to build a CA pool that picks up newly
+// installed certificates without restarting the process -- unlike
+// x509.SystemCertPool(), which Go may cache for the life of the process.
+var systemCertDirs = []string{
+	"/etc/ssl/certs",
+	"/etc/pki/tls/certs",
+	"/usr/share/ca-certificates",
+	"/usr/local/share/certs",
+	"/system/etc/security/cacerts",
+}
+
+// certBundle resolves the CA pool to trust, modeled on
+// hashicorp/go-rootcerts: an explicit --ca-bundle-path (file or
+// directory) wins, then the SSL_CERT_FILE and SSL_CERT_DIR environment
+// variables, then the OS trust store.
 func certBundle(caBundlePath string) (*x509.CertPool, error) {
 	if caBundlePath == "" {
-		return x509.SystemCertPool()
+		caBundlePath = os.Getenv("SSL_CERT_FILE")
+	}
+	if caBundlePath == "" {
+		caBundlePath = os.Getenv("SSL_CERT_DIR")
 	}
 
-	caBundleBytes, err := ioutil.ReadFile(caBundlePath)
+	if caBundlePath != "" {
+		return loadCABundlePath(caBundlePath)
+	}
+
+	if pool, err := loadSystemCertDirs(); err == nil {
+		return pool, nil
+	}
+
+	return x509.SystemCertPool()
+}
+
+// loadCABundlePath loads every PEM-encoded certificate found at path,
+// which may be a single bundle file or a directory of *.pem/*.crt files.
+func loadCABundlePath(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
 	bundle := x509.NewCertPool()
-	if !bundle.AppendCertsFromPEM(caBundleBytes) {
-		return nil, fmt.Errorf("unable to parse ca-bundle")
+	if !info.IsDir() {
+		caBundleBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !bundle.AppendCertsFromPEM(caBundleBytes) {
+			return nil, fmt.Errorf("unable to parse ca-bundle: %s", path)
+		}
+		return bundle, nil
+	}
+
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".pem", ".crt":
+		default:
+			return nil
+		}
+
+		pemBytes, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !bundle.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("unable to parse certificate: %s", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return bundle, nil
 }
 
-// buildConfig reads command-line options and builds a tls.Config
-func buildConfig(caBundlePath string) (*tls.Config, error) {
-	caBundle, err := certBundle(caBundlePath)
-	if err != nil {
+// loadSystemCertDirs walks systemCertDirs directly, bypassing Go's
+// process-lifetime SystemCertPool cache, so --ca-reload-interval can
+// observe trust anchors installed by a package manager after startup.
+func loadSystemCertDirs() (*x509.CertPool, error) {
+	bundle := x509.NewCertPool()
+	loaded := false
+
+	for _, dir := range systemCertDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			pemBytes, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			if bundle.AppendCertsFromPEM(pemBytes) {
+				loaded = true
+			}
+		}
+	}
+
+	if !loaded {
+		return nil, fmt.Errorf("no system CA certificates found in %v", systemCertDirs)
+	}
+	return bundle, nil
+}
+
+// caBundle wraps a CA certificate pool in a reloadable way, mirroring
+// how certificate wraps a reloadable leaf certificate.
+type caBundle struct {
+	caBundlePath string
+	cached       unsafe.Pointer // *x509.CertPool
+
+	ticker *time.Ticker
+	stopCh chan struct{}
+}
+
+// buildCABundle loads the CA pool and, if reloadInterval is positive,
+// starts a background refresh so long-running processes pick up CA
+// updates from package managers without a restart.
+func buildCABundle(caBundlePath string, reloadInterval time.Duration) (*caBundle, error) {
+	bundle := &caBundle{caBundlePath: caBundlePath}
+	if err := bundle.reload(); err != nil {
 		return nil, err
 	}
 
-	return &tls.Config{
-		// Certificates
-		RootCAs:   caBundle,
-		ClientCAs: caBundle,
+	if reloadInterval > 0 {
+		bundle.startReloader(reloadInterval)
+	}
+	return bundle, nil
+}
 
-		PreferServerCipherSuites: true,
+func (b *caBundle) reload() error {
+	pool, err := certBundle(b.caBundlePath)
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&b.cached, unsafe.Pointer(pool))
+	return nil
+}
+
+// get returns the currently cached CA pool.
+func (b *caBundle) get() *x509.CertPool {
+	return (*x509.CertPool)(atomic.LoadPointer(&b.cached))
+}
 
-		ClientAuth: tls.RequireAndVerifyClientCert,
+func (b *caBundle) startReloader(interval time.Duration) {
+	b.ticker = time.NewTicker(interval)
+	b.stopCh = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-b.ticker.C:
+				if err := b.reload(); err != nil {
+					log.Printf("ca-bundle reload: %s", err)
+				}
+			case <-b.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop tears down the background refresh goroutine.
+func (b *caBundle) Stop() {
+	if b.ticker != nil {
+		b.ticker.Stop()
+	}
+	if b.stopCh != nil {
+		close(b.stopCh)
+	}
+}
+
+// VerificationMode controls how much of the peer's certificate is
+// checked, matching the beats-style verification modes.
+type VerificationMode string
+
+const (
+	// VerifyFull verifies the certificate chain and that the hostname
+	// matches the certificate, like Go's default TLS behaviour. This is
+	// the default.
+	VerifyFull VerificationMode = "full"
+	// VerifyCertificate verifies the certificate chain but does not
+	// check the hostname.
+	VerifyCertificate VerificationMode = "certificate"
+	// VerifyNone disables verification entirely. Dangerous outside of
+	// testing -- only trust this with peers authenticated some other way.
+	VerifyNone VerificationMode = "none"
+)
+
+// TLSPolicy bundles the set of tunables that used to be hardcoded in
+// buildConfig, so they can be populated from flags.
+type TLSPolicy struct {
+	MinVersion, MaxVersion uint16
+	CipherSuites           []uint16
+	CurvePreferences       []tls.CurveID
+	ClientAuth             tls.ClientAuthType
+	VerificationMode       VerificationMode
+}
+
+// defaultTLSPolicy returns the policy ghostunnel used before these were
+// configurable, used when no overriding flags are given.
+func defaultTLSPolicy() TLSPolicy {
+	return TLSPolicy{
 		MinVersion: tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
@@ -120,5 +927,202 @@ func buildConfig(caBundlePath string) (*tls.Config, error) {
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 		},
-	}, nil
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerificationMode: VerifyFull,
+	}
+}
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var cipherSuitesByName = map[string]uint16{
+	// TLS 1.0-1.2 suites. The four AES-GCM ones are ghostunnel's
+	// historical defaults (see defaultTLSPolicy).
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	// TLS 1.3 suites. They are accepted by --cipher-suites, but Go
+	// ignores tls.Config.CipherSuites for 1.3 handshakes and picks among
+	// these itself, so listing them does not restrict which are offered.
+	"TLS_AES_128_GCM_SHA256":       tls.TLS_AES_128_GCM_SHA256,
+	"TLS_AES_256_GCM_SHA384":       tls.TLS_AES_256_GCM_SHA384,
+	"TLS_CHACHA20_POLY1305_SHA256": tls.TLS_CHACHA20_POLY1305_SHA256,
+}
+
+var curvesByName = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// ParseTLSVersion converts a flag value like "1.2" or "1.3" into the
+// corresponding tls.VersionTLS* constant.
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersionsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s (choose one of 1.0, 1.1, 1.2, 1.3)", name)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites converts flag values like "TLS_AES_128_GCM_SHA256"
+// into the corresponding tls.TLS_* constants, rejecting unknown names.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := cipherSuitesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// ParseCurves converts flag values like "X25519" or "P-256" into the
+// corresponding tls.CurveID constants, rejecting unknown names.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := curvesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %s", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// ParseVerificationMode converts a --verify-mode flag value into a
+// VerificationMode, defaulting to VerifyFull when empty.
+func ParseVerificationMode(name string) (VerificationMode, error) {
+	switch VerificationMode(name) {
+	case "", VerifyFull:
+		return VerifyFull, nil
+	case VerifyCertificate:
+		return VerifyCertificate, nil
+	case VerifyNone:
+		return VerifyNone, nil
+	default:
+		return "", fmt.Errorf("unknown verification mode: %s (choose one of none, certificate, full)", name)
+	}
+}
+
+// buildConfig reads command-line options and builds a tls.Config.
+// peerEKU is the extended key usage the peer's certificate must carry:
+// pass x509.ExtKeyUsageClientAuth when config is used for a listener
+// verifying clients, or x509.ExtKeyUsageServerAuth when used for a
+// dialer verifying servers (this also determines whether the peer's
+// hostname gets checked -- only dialing a server has one to check
+// against). caReloadInterval, if positive, keeps the CA pool fresh in
+// the background (see buildCABundle) and wires GetConfigForClient, and
+// (for VerifyFull/VerifyCertificate) a VerifyConnection callback, so
+// both inbound and outbound handshakes pick up the latest
+// RootCAs/ClientCAs rather than the pool captured at build time.
+func buildConfig(caBundlePath string, caReloadInterval time.Duration, peerEKU x509.ExtKeyUsage, policy TLSPolicy) (*tls.Config, error) {
+	bundle, err := buildCABundle(caBundlePath, caReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		// Certificates
+		RootCAs:   bundle.get(),
+		ClientCAs: bundle.get(),
+
+		PreferServerCipherSuites: true,
+
+		ClientAuth:       policy.ClientAuth,
+		MinVersion:       policy.MinVersion,
+		MaxVersion:       policy.MaxVersion,
+		CipherSuites:     policy.CipherSuites,
+		CurvePreferences: policy.CurvePreferences,
+	}
+
+	checkHostname := peerEKU == x509.ExtKeyUsageServerAuth
+
+	switch policy.VerificationMode {
+	case VerifyNone:
+		config.InsecureSkipVerify = true
+		// InsecureSkipVerify only disables the dialer's own check of the
+		// peer it connects to; on the listener side, verification of the
+		// client's certificate is driven entirely by ClientAuth, which
+		// defaults to RequireAndVerifyClientCert. Drop that too, or
+		// verify-mode=none would leave client-cert verification on.
+		config.ClientAuth = tls.NoClientCert
+	case VerifyCertificate:
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyChain(bundle.get, peerEKU, false)
+	case VerifyFull, "":
+		if caReloadInterval > 0 {
+			// GetConfigForClient below keeps RootCAs/ClientCAs fresh for
+			// inbound handshakes, but it's server-only -- ghostunnel also
+			// uses this config to dial out, and Go never re-resolves a
+			// client's RootCAs mid-config-lifetime. Do the chain/hostname
+			// check ourselves against the live bundle so the reload
+			// covers outbound connections too.
+			config.InsecureSkipVerify = true
+			config.VerifyConnection = verifyChain(bundle.get, peerEKU, checkHostname)
+		}
+	default:
+		return nil, fmt.Errorf("unknown verification mode: %s", policy.VerificationMode)
+	}
+
+	if caReloadInterval > 0 {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			live := config.Clone()
+			live.GetConfigForClient = nil
+			live.RootCAs = bundle.get()
+			live.ClientCAs = bundle.get()
+			return live, nil
+		}
+	}
+
+	return config, nil
+}
+
+// verifyChain builds a VerifyConnection callback that checks the peer's
+// certificate chain against the pool returned by roots (called
+// per-handshake, so it reflects the latest CA reload), that the leaf
+// carries peerEKU, and, if checkHostname is set, that the leaf matches
+// the hostname this specific connection was dialed with -- the same
+// checks Go's built-in verification does against a static RootCAs
+// pool, just resolved fresh on every handshake. Using VerifyConnection
+// rather than VerifyPeerCertificate matters here: cs.ServerName
+// reflects the per-connection config (e.g. a per-dial clone with its
+// own ServerName) rather than whatever the base *tls.Config happened to
+// be built with.
+func verifyChain(roots func() *x509.CertPool, peerEKU x509.ExtKeyUsage, checkHostname bool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		if len(certs) == 0 {
+			return fmt.Errorf("tls: no certificate presented by peer")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		var dnsName string
+		if checkHostname {
+			dnsName = cs.ServerName
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots(),
+			Intermediates: intermediates,
+			DNSName:       dnsName,
+			KeyUsages:     []x509.ExtKeyUsage{peerEKU},
+		})
+		return err
+	}
 }